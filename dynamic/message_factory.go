@@ -1,31 +1,55 @@
 package dynamic
 
 import (
+	"fmt"
 	"reflect"
+	"strings"
 	"sync"
 
 	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/runtime/protoimpl"
+	"google.golang.org/protobuf/types/known/anypb"
 
 	"github.com/jhump/protoreflect/desc"
 )
 
-// MessageFactory can be used to create new empty message objects.
-type MessageFactory struct {
+// MessageFactory can be used to create new empty message objects. DefaultMessageFactory
+// is the implementation used throughout this package unless told otherwise; it decides
+// between a generated struct and a dynamic message by consulting a KnownTypeRegistry.
+// Other implementations allow type resolution strategies that live outside this package,
+// such as one that resolves type URLs against a remote descriptor service. See also
+// ChainedMessageFactory, for combining multiple factories into one.
+type MessageFactory interface {
+	NewMessage(md *desc.MessageDescriptor) proto.Message
+}
+
+var _ MessageFactory = (*DefaultMessageFactory)(nil)
+
+// DefaultMessageFactory is the default implementation of MessageFactory. It creates a
+// generated struct for descriptors that correspond to a "known type" (per its configured
+// KnownTypeRegistry) and a dynamic message for everything else.
+type DefaultMessageFactory struct {
 	er  *ExtensionRegistry
 	ktr *KnownTypeRegistry
+
+	mu          sync.RWMutex
+	anyResolver AnyResolver
+	anyURLPfx   string
 }
 
 // NewMessageFactoryWithExtensionRegistry creates a new message factory where any
 // dynamic messages produced will use the given extension registry to recognize and
 // parse extension fields.
-func NewMessageFactoryWithExtensionRegistry(er *ExtensionRegistry) *MessageFactory {
+func NewMessageFactoryWithExtensionRegistry(er *ExtensionRegistry) *DefaultMessageFactory {
 	return NewMessageFactoryWithRegistries(er, nil)
 }
 
 // NewMessageFactoryWithKnownTypeRegistry creates a new message factory where the
 // known types, per the given registry, will be returned as normal protobuf messages
 // (e.g. generated structs, instead of dynamic messages).
-func NewMessageFactoryWithKnownTypeRegistry(ktr *KnownTypeRegistry) *MessageFactory {
+func NewMessageFactoryWithKnownTypeRegistry(ktr *KnownTypeRegistry) *DefaultMessageFactory {
 	return NewMessageFactoryWithRegistries(nil, ktr)
 }
 
@@ -36,14 +60,14 @@ func NewMessageFactoryWithKnownTypeRegistry(ktr *KnownTypeRegistry) *MessageFact
 //   NewMessageFactoryWithRegistries(
 //       NewExtensionRegistryWithDefaults(),
 //       NewKnownTypeRegistryWithDefaults())
-func NewMessageFactoryWithDefaults() *MessageFactory {
+func NewMessageFactoryWithDefaults() *DefaultMessageFactory {
 	return NewMessageFactoryWithRegistries(NewExtensionRegistryWithDefaults(), NewKnownTypeRegistryWithDefaults())
 }
 
 // NewMessageFactoryWithRegistries creates a new message factory with the given extension
 // and known type registries.
-func NewMessageFactoryWithRegistries(er *ExtensionRegistry, ktr *KnownTypeRegistry) *MessageFactory {
-	return &MessageFactory{
+func NewMessageFactoryWithRegistries(er *ExtensionRegistry, ktr *KnownTypeRegistry) *DefaultMessageFactory {
+	return &DefaultMessageFactory{
 		er:  er,
 		ktr: ktr,
 	}
@@ -52,16 +76,209 @@ func NewMessageFactoryWithRegistries(er *ExtensionRegistry, ktr *KnownTypeRegist
 // NewMessage creates a new empty message that corresponds to the given descriptor.
 // If the given descriptor describes a "known type" then that type is instantiated.
 // Otherwise, an empty dynamic message is returned.
-func (f *MessageFactory) NewMessage(md *desc.MessageDescriptor) proto.Message {
+func (f *DefaultMessageFactory) NewMessage(md *desc.MessageDescriptor) proto.Message {
 	if f == nil {
 		return NewMessage(md)
 	}
 	if m := f.ktr.CreateIfKnown(md.GetFullyQualifiedName()); m != nil {
 		return m
 	}
+	// newMessageWithMessageFactory, along with the rest of this package's JSON/text
+	// marshalers and extension parsing, lives outside dynamic/message_factory.go and
+	// must take the MessageFactory interface (not *DefaultMessageFactory specifically)
+	// now that MessageFactory is no longer a concrete struct.
 	return newMessageWithMessageFactory(md, f)
 }
 
+var _ MessageFactory = (*ChainedMessageFactory)(nil)
+
+// ChainedMessageFactory returns a MessageFactory that consults an ordered list of
+// factories to construct a message for a given descriptor. Each factory is tried in
+// turn; the first one that returns something other than a generic dynamic message wins.
+// If none of them recognize the type, a new dynamic message for the descriptor is
+// returned; dynamic messages produced by the chained factories are discarded. This is useful for composing multiple type-resolution
+// strategies, e.g. one backed by statically-linked generated types and another that
+// resolves types from a remote descriptor service.
+type ChainedMessageFactory struct {
+	factories []MessageFactory
+}
+
+// NewChainedMessageFactory creates a new MessageFactory that tries each of the given
+// factories, in order, until one of them recognizes the descriptor's type.
+func NewChainedMessageFactory(factories ...MessageFactory) *ChainedMessageFactory {
+	return &ChainedMessageFactory{factories: factories}
+}
+
+// NewMessage implements the MessageFactory interface. It never returns nil: if the chain
+// is empty, or every wrapped factory returns either a dynamic message or nil (which a
+// well-behaved MessageFactory should never do, but third-party implementations cannot be
+// trusted to honor that), a dynamic message for md is returned instead.
+func (f *ChainedMessageFactory) NewMessage(md *desc.MessageDescriptor) proto.Message {
+	for _, fact := range f.factories {
+		m := fact.NewMessage(md)
+		if m != nil {
+			if _, ok := m.(*Message); !ok {
+				return m
+			}
+		}
+	}
+	return NewMessage(md)
+}
+
+// AnyResolver resolves a fully-qualified message name into a descriptor. It is used by
+// MessageFactory to materialize dynamic messages for google.protobuf.Any payloads whose
+// type is not registered as a known type.
+type AnyResolver interface {
+	FindMessageByName(name string) (*desc.MessageDescriptor, error)
+}
+
+// SetAnyResolver configures the resolver this factory will use, when unmarshalling a
+// google.protobuf.Any message, to find a descriptor for types that are not known types.
+// If no resolver is set (or the given resolver cannot find the type), unmarshalling an
+// Any whose type is not a known type will fail.
+func (f *DefaultMessageFactory) SetAnyResolver(r AnyResolver) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.anyResolver = r
+}
+
+// SetAnyURLPrefix configures the URL prefix used by MarshalAny. The default, used when
+// this is not called (or called with an empty string), is "type.googleapis.com", per the
+// google.protobuf.Any documentation.
+func (f *DefaultMessageFactory) SetAnyURLPrefix(prefix string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.anyURLPfx = prefix
+}
+
+func (f *DefaultMessageFactory) getAnyResolver() AnyResolver {
+	if f == nil {
+		return nil
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.anyResolver
+}
+
+const defaultAnyURLPrefix = "type.googleapis.com"
+
+func (f *DefaultMessageFactory) anyURLPrefix() string {
+	pfx := defaultAnyURLPrefix
+	if f != nil {
+		f.mu.RLock()
+		if f.anyURLPfx != "" {
+			pfx = f.anyURLPfx
+		}
+		f.mu.RUnlock()
+	}
+	return strings.TrimSuffix(pfx, "/")
+}
+
+// MarshalAny wraps the given message in a new google.protobuf.Any message. The type URL
+// of the returned Any is constructed from the factory's URL prefix (see SetAnyURLPrefix)
+// and the fully-qualified name of m's type.
+func (f *DefaultMessageFactory) MarshalAny(m proto.Message) (*anypb.Any, error) {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return &anypb.Any{
+		TypeUrl: f.anyURLPrefix() + "/" + proto.MessageName(m),
+		Value:   b,
+	}, nil
+}
+
+// UnmarshalAny unmarshals the given Any message's payload. The type is resolved by
+// looking at the Any's TypeUrl: if it names a known type (see KnownTypeRegistry), an
+// instance of that generated type is returned; otherwise, the factory's configured
+// AnyResolver (see SetAnyResolver) is used to find a message descriptor, and a dynamic
+// message is returned instead. It is an error if the type is not known and no resolver
+// is configured (or the configured resolver cannot find the named type).
+func (f *DefaultMessageFactory) UnmarshalAny(any *anypb.Any) (proto.Message, error) {
+	name, err := typeNameFromURL(any.GetTypeUrl())
+	if err != nil {
+		return nil, err
+	}
+
+	var msg proto.Message
+	if f == nil {
+		msg = (*KnownTypeRegistry)(nil).CreateIfKnown(name)
+	} else {
+		msg = f.ktr.CreateIfKnown(name)
+	}
+	if msg == nil {
+		resolver := f.getAnyResolver()
+		if resolver == nil {
+			return nil, fmt.Errorf("dynamic: cannot resolve message type %q: no AnyResolver configured", name)
+		}
+		md, err := resolver.FindMessageByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("dynamic: could not resolve message type %q: %v", name, err)
+		}
+		msg = f.NewMessage(md)
+	}
+
+	if err := proto.Unmarshal(any.GetValue(), msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// UnmarshalAnyInto unmarshals the given Any message's payload into dst. Unlike
+// UnmarshalAny, no type resolution is needed since the destination message is supplied
+// by the caller; the Any's TypeUrl is merely checked to make sure its message name
+// matches that of dst.
+func (f *DefaultMessageFactory) UnmarshalAnyInto(any *anypb.Any, dst proto.Message) error {
+	name, err := typeNameFromURL(any.GetTypeUrl())
+	if err != nil {
+		return err
+	}
+	if want := proto.MessageName(dst); want != "" && want != name {
+		return fmt.Errorf("dynamic: cannot unmarshal %q into message of type %q", name, want)
+	}
+	return proto.Unmarshal(any.GetValue(), dst)
+}
+
+// NewMessageForURL is like NewMessage, but takes a type URL (as used by
+// google.protobuf.Any and gRPC server reflection) instead of a descriptor. If the named
+// type is known (see KnownTypeRegistry), an instance of its generated type is returned;
+// otherwise, resolve is invoked to look up a descriptor for the name, and the result is
+// passed to NewMessage. The typeURL may be a bare message name or a full URL such as
+// "type.googleapis.com/foo.Bar"; see CreateIfKnownByURL for the parsing rules.
+func (f *DefaultMessageFactory) NewMessageForURL(typeURL string, resolve func(name string) (*desc.MessageDescriptor, error)) (proto.Message, error) {
+	name, err := typeNameFromURL(typeURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var ktr *KnownTypeRegistry
+	if f != nil {
+		ktr = f.ktr
+	}
+	if m := ktr.CreateIfKnown(name); m != nil {
+		return m, nil
+	}
+
+	md, err := resolve(name)
+	if err != nil {
+		return nil, fmt.Errorf("dynamic: could not resolve message type %q: %v", name, err)
+	}
+	return f.NewMessage(md), nil
+}
+
+// typeNameFromURL extracts and validates the fully-qualified message name from a
+// google.protobuf.Any type URL, per the Any spec: everything after the last slash.
+func typeNameFromURL(url string) (string, error) {
+	name := url
+	if idx := strings.LastIndex(url, "/"); idx >= 0 {
+		name = url[idx+1:]
+	}
+	if !protoreflect.FullName(name).IsValid() {
+		return "", fmt.Errorf("dynamic: type URL %q does not contain a valid fully-qualified message name", url)
+	}
+	return name, nil
+}
+
 type wkt interface {
 	XXX_WellKnownType() string
 }
@@ -81,6 +298,8 @@ type KnownTypeRegistry struct {
 	includeDefault bool
 	mu             sync.RWMutex
 	types          map[string]reflect.Type
+	v2Types        map[string]protoreflect.MessageType
+	v2Resolver     protoregistry.MessageTypeResolver
 }
 
 // NewKnownTypeRegistryWithDefaults creates a new registry that knows about all
@@ -109,6 +328,107 @@ func (r *KnownTypeRegistry) AddKnownType(kts ...proto.Message) {
 	}
 }
 
+// AddKnownTypeV2 adds the given message type, defined via the newer
+// google.golang.org/protobuf API (APIv2), as a known type. This is useful for
+// applications that are migrating away from the legacy github.com/golang/protobuf
+// registration functions (proto.RegisterType et al) to the APIv2 registry. Like
+// AddKnownType, this is an explicit, opt-in registration: it takes effect regardless of
+// excludeWkt/includeDefault, unlike the broader protoregistry.GlobalTypes fallback (see
+// CreateIfKnown).
+func (r *KnownTypeRegistry) AddKnownTypeV2(mt protoreflect.MessageType) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.v2Types == nil {
+		r.v2Types = map[string]protoreflect.MessageType{}
+	}
+	r.v2Types[string(mt.Descriptor().FullName())] = mt
+}
+
+// SetMessageTypeResolver configures the protoregistry.MessageTypeResolver that this
+// registry consults, as a fallback, when a name is not found among the types added via
+// AddKnownType or AddKnownTypeV2. If this is never called, protoregistry.GlobalTypes is
+// used. The fallback is gated like the legacy v1 lookup: a registry created via
+// NewKnownTypeRegistryWithDefaults may resolve any type through it, a registry that
+// includes the well-known types resolves only well-known types through it, and a
+// registry created via NewKnownTypeRegistryWithoutWellKnownTypes never consults it.
+func (r *KnownTypeRegistry) SetMessageTypeResolver(res protoregistry.MessageTypeResolver) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.v2Resolver = res
+}
+
+// NewKnownTypeRegistryFromProtoRegistry creates a new registry that is seeded with every
+// message type registered in the given protoregistry.Types. This is useful for
+// applications that register their generated types with the APIv2 registry (instead of,
+// or in addition to, the legacy v1 registration functions) and want those registrations
+// reflected in a KnownTypeRegistry.
+func NewKnownTypeRegistryFromProtoRegistry(reg *protoregistry.Types) *KnownTypeRegistry {
+	r := &KnownTypeRegistry{}
+	reg.RangeMessages(func(mt protoreflect.MessageType) bool {
+		r.AddKnownTypeV2(mt)
+		return true
+	})
+	return r
+}
+
+// AddKnownTypesFromFile walks every message declared in the given file, including
+// nested messages, and registers each fully-qualified name whose Go type is linked into
+// the program -- checked via both the legacy v1 registry (proto.MessageType) and the
+// APIv2 global registry (protoregistry.GlobalTypes) -- as a known type. This lets an
+// application that loads .proto files at runtime, but also links some generated code,
+// get generated structs for that linked subset automatically, without enumerating each
+// message by hand via AddKnownType.
+func (r *KnownTypeRegistry) AddKnownTypesFromFile(fd *desc.FileDescriptor) {
+	for _, md := range fd.GetMessageTypes() {
+		r.addKnownTypesFromMessage(md)
+	}
+}
+
+// AddKnownTypesFromFiles is AddKnownTypesFromFile for multiple files.
+func (r *KnownTypeRegistry) AddKnownTypesFromFiles(fds ...*desc.FileDescriptor) {
+	for _, fd := range fds {
+		r.AddKnownTypesFromFile(fd)
+	}
+}
+
+func (r *KnownTypeRegistry) addKnownTypesFromMessage(md *desc.MessageDescriptor) {
+	name := md.GetFullyQualifiedName()
+	if t := proto.MessageType(name); t != nil {
+		r.mu.Lock()
+		if r.types == nil {
+			r.types = map[string]reflect.Type{}
+		}
+		r.types[name] = t
+		r.mu.Unlock()
+	} else if mt, err := protoregistry.GlobalTypes.FindMessageByName(protoreflect.FullName(name)); err == nil {
+		r.AddKnownTypeV2(mt)
+	}
+	for _, nmd := range md.GetNestedMessageTypes() {
+		r.addKnownTypesFromMessage(nmd)
+	}
+}
+
+// NewKnownTypeRegistryFromFiles creates a new registry that is seeded, via
+// AddKnownTypesFromFiles, with every message declared in the given files whose Go type
+// is linked into the program.
+func NewKnownTypeRegistryFromFiles(fds ...*desc.FileDescriptor) *KnownTypeRegistry {
+	r := &KnownTypeRegistry{}
+	r.AddKnownTypesFromFiles(fds...)
+	return r
+}
+
+// CreateIfKnownByURL is like CreateIfKnown, except that it accepts a google.protobuf.Any
+// type URL (e.g. "type.googleapis.com/foo.Bar") in addition to a bare message name. If
+// the URL cannot be parsed, an error is returned; if it can be parsed but does not name a
+// known type, nil is returned (with no error), matching CreateIfKnown's contract.
+func (r *KnownTypeRegistry) CreateIfKnownByURL(typeURL string) (proto.Message, error) {
+	name, err := typeNameFromURL(typeURL)
+	if err != nil {
+		return nil, err
+	}
+	return r.CreateIfKnown(name), nil
+}
+
 // CreateIfKnown will construct an instance of the given message if it is a known type.
 // If the given name is unknown, nil is returned.
 func (r *KnownTypeRegistry) CreateIfKnown(messageName string) proto.Message {
@@ -136,7 +456,7 @@ func (r *KnownTypeRegistry) CreateIfKnown(messageName string) proto.Message {
 	}
 
 	if msgType == nil {
-		return nil
+		return r.createIfKnownV2(messageName)
 	}
 
 	if msgType.Kind() == reflect.Ptr {
@@ -144,4 +464,64 @@ func (r *KnownTypeRegistry) CreateIfKnown(messageName string) proto.Message {
 	} else {
 		return reflect.New(msgType).Elem().Interface().(proto.Message)
 	}
+}
+
+// createIfKnownV2 is the APIv2 analog of CreateIfKnown: it consults types added via
+// AddKnownTypeV2 (an explicit, opt-in registration, so it is always consulted) and then,
+// if still not found, falls back to the registry's configured
+// protoregistry.MessageTypeResolver (or protoregistry.GlobalTypes, if none is
+// configured). That broader fallback is gated exactly like the v1 lookup in
+// CreateIfKnown -- only tried for includeDefault registries, or for types that turn out
+// to be well-known types when !excludeWkt -- so that a zero-value registry or one
+// created via NewKnownTypeRegistryWithoutWellKnownTypes keeps its documented guarantees
+// even when packages like anypb or timestamppb are merely linked into the binary.
+func (r *KnownTypeRegistry) createIfKnownV2(messageName string) proto.Message {
+	var mt protoreflect.MessageType
+	if r != nil {
+		r.mu.RLock()
+		mt = r.v2Types[messageName]
+		r.mu.RUnlock()
+	}
+	if mt != nil {
+		return messageV1Of(mt.New().Interface())
+	}
+
+	includeDefault := r != nil && r.includeDefault
+	excludeWkt := r != nil && r.excludeWkt
+	if !includeDefault && excludeWkt {
+		return nil
+	}
+
+	var resolver protoregistry.MessageTypeResolver = protoregistry.GlobalTypes
+	if r != nil {
+		r.mu.RLock()
+		if r.v2Resolver != nil {
+			resolver = r.v2Resolver
+		}
+		r.mu.RUnlock()
+	}
+
+	found, err := resolver.FindMessageByName(protoreflect.FullName(messageName))
+	if err != nil {
+		return nil
+	}
+
+	msg := messageV1Of(found.New().Interface())
+	if !includeDefault {
+		// only !excludeWkt path reaches here; only well-known types are allowed
+		if _, ok := msg.(wkt); !ok {
+			return nil
+		}
+	}
+	return msg
+}
+
+// messageV1Of adapts an APIv2 message to the legacy proto.Message interface, using
+// protoimpl.X.ProtoMessageV1Of for the (rare) type that implements only the APIv2
+// protoreflect.ProtoMessage interface.
+func messageV1Of(m protoreflect.ProtoMessage) proto.Message {
+	if v1, ok := m.(proto.Message); ok {
+		return v1
+	}
+	return protoimpl.X.ProtoMessageV1Of(m)
 }
\ No newline at end of file
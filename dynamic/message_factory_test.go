@@ -0,0 +1,163 @@
+package dynamic
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/jhump/protoreflect/desc"
+)
+
+func TestMessageFactoryMarshalUnmarshalAnyRoundTrip(t *testing.T) {
+	f := NewMessageFactoryWithDefaults()
+	msg := &wrapperspb.StringValue{Value: "hello"}
+
+	any, err := f.MarshalAny(msg)
+	if err != nil {
+		t.Fatalf("MarshalAny failed: %v", err)
+	}
+	wantURL := "type.googleapis.com/google.protobuf.StringValue"
+	if any.GetTypeUrl() != wantURL {
+		t.Errorf("TypeUrl = %q, want %q", any.GetTypeUrl(), wantURL)
+	}
+
+	got, err := f.UnmarshalAny(any)
+	if err != nil {
+		t.Fatalf("UnmarshalAny failed: %v", err)
+	}
+	sv, ok := got.(*wrapperspb.StringValue)
+	if !ok {
+		t.Fatalf("UnmarshalAny returned %T, want *wrapperspb.StringValue", got)
+	}
+	if sv.GetValue() != "hello" {
+		t.Errorf("round-tripped value = %q, want %q", sv.GetValue(), "hello")
+	}
+
+	var dst wrapperspb.StringValue
+	if err := f.UnmarshalAnyInto(any, &dst); err != nil {
+		t.Fatalf("UnmarshalAnyInto failed: %v", err)
+	}
+	if dst.GetValue() != "hello" {
+		t.Errorf("UnmarshalAnyInto value = %q, want %q", dst.GetValue(), "hello")
+	}
+}
+
+// TestKnownTypeRegistryV2ResolverGating ensures the APIv2 fallback in createIfKnownV2
+// respects the same includeDefault/excludeWkt gating as the legacy v1 lookup: it must
+// not auto-discover arbitrary linked types for a registry that didn't ask for them, but
+// an explicit AddKnownTypeV2 registration is always honored.
+func TestKnownTypeRegistryV2ResolverGating(t *testing.T) {
+	mt := (&anypb.Any{}).ProtoReflect().Type()
+	name := string(mt.Descriptor().FullName())
+
+	reg := new(protoregistry.Types)
+	if err := reg.RegisterMessage(mt); err != nil {
+		t.Fatalf("failed to register test type: %v", err)
+	}
+
+	excluded := NewKnownTypeRegistryWithoutWellKnownTypes()
+	excluded.SetMessageTypeResolver(reg)
+	if m := excluded.CreateIfKnown(name); m != nil {
+		t.Errorf("excludeWkt registry: CreateIfKnown(%q) = %T, want nil (resolver fallback should not be consulted)", name, m)
+	}
+
+	included := NewKnownTypeRegistryWithDefaults()
+	included.SetMessageTypeResolver(reg)
+	if m := included.CreateIfKnown(name); m == nil {
+		t.Errorf("includeDefault registry: CreateIfKnown(%q) = nil, want a resolved message", name)
+	}
+
+	explicit := NewKnownTypeRegistryWithoutWellKnownTypes()
+	explicit.AddKnownTypeV2(mt)
+	if m := explicit.CreateIfKnown(name); m == nil {
+		t.Errorf("explicit AddKnownTypeV2 registration: CreateIfKnown(%q) = nil, want it honored even with excludeWkt", name)
+	}
+}
+
+// TestChainedMessageFactoryEmptyReturnsDynamicMessage ensures an empty chain falls back
+// to a dynamic message instead of nil.
+func TestChainedMessageFactoryEmptyReturnsDynamicMessage(t *testing.T) {
+	md, err := desc.LoadMessageDescriptorForMessage(&anypb.Any{})
+	if err != nil {
+		t.Fatalf("failed to load descriptor: %v", err)
+	}
+
+	f := NewChainedMessageFactory()
+	m := f.NewMessage(md)
+	if m == nil {
+		t.Fatal("ChainedMessageFactory with no factories returned nil, want a dynamic message")
+	}
+	if _, ok := m.(*Message); !ok {
+		t.Fatalf("ChainedMessageFactory with no factories returned %T, want a *dynamic.Message", m)
+	}
+}
+
+// TestAddKnownTypesFromFileWalksNestedMessages ensures AddKnownTypesFromFile recurses
+// into nested message types, not just the file's top-level messages.
+func TestAddKnownTypesFromFileWalksNestedMessages(t *testing.T) {
+	fd, err := desc.LoadFileDescriptor("google/protobuf/descriptor.proto")
+	if err != nil {
+		t.Fatalf("failed to load descriptor.proto: %v", err)
+	}
+
+	r := NewKnownTypeRegistryFromFiles(fd)
+
+	const nestedName = "google.protobuf.DescriptorProto.ExtensionRange"
+	if m := r.CreateIfKnown(nestedName); m == nil {
+		t.Errorf("CreateIfKnown(%q) = nil, want nested message to be registered", nestedName)
+	}
+}
+
+// TestCreateIfKnownByURL ensures the URL parsing and validation used by
+// CreateIfKnownByURL (and, in turn, NewMessageForURL) rejects malformed type URLs.
+func TestCreateIfKnownByURL(t *testing.T) {
+	r := NewKnownTypeRegistryWithDefaults()
+
+	if _, err := r.CreateIfKnownByURL("foo/"); err == nil {
+		t.Error(`CreateIfKnownByURL("foo/"): expected error for missing message name`)
+	}
+	if _, err := r.CreateIfKnownByURL("not valid"); err == nil {
+		t.Error(`CreateIfKnownByURL("not valid"): expected error for invalid message name`)
+	}
+
+	m, err := r.CreateIfKnownByURL("type.googleapis.com/google.protobuf.Any")
+	if err != nil {
+		t.Fatalf("CreateIfKnownByURL: unexpected error: %v", err)
+	}
+	if m == nil {
+		t.Error("CreateIfKnownByURL(\"type.googleapis.com/google.protobuf.Any\") = nil, want a resolved message")
+	}
+}
+
+func TestTypeNameFromURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		want    string
+		wantErr bool
+	}{
+		{url: "type.googleapis.com/foo.Bar", want: "foo.Bar"},
+		{url: "custom.prefix/foo.Bar.Baz", want: "foo.Bar.Baz"},
+		{url: "foo.Bar", want: "foo.Bar"},
+		{url: "foo/", wantErr: true},
+		{url: "not valid", wantErr: true},
+		{url: "", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := typeNameFromURL(tc.url)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("typeNameFromURL(%q): expected error, got %q", tc.url, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("typeNameFromURL(%q): unexpected error: %v", tc.url, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("typeNameFromURL(%q) = %q, want %q", tc.url, got, tc.want)
+		}
+	}
+}